@@ -0,0 +1,157 @@
+package rbaceval
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/ext"
+)
+
+// CELMatcherTypeURL is the extension type_url a Permission or Principal
+// built with ExtensionPermission/ExtensionPrincipal must use to be
+// evaluated by the reference CEL matcher registered below, e.g.:
+//
+//	principal := rbaceval.ExtensionPrincipal(rbaceval.ExtensionConfig{
+//		Config: &types.Any{
+//			TypeUrl: rbaceval.CELMatcherTypeURL,
+//			Value:   []byte(`request.headers['x-tenant'] == source.principal.split('/')[2]`),
+//		},
+//	})
+//
+// A policy authored directly in YAML/JSON reaches the same matcher by using
+// the extensionFilter Metadata convention (see Compile) with this type URL
+// as the sole path segment's key and the CEL expression as the metadata
+// value's string_match.exact.
+const CELMatcherTypeURL = "type.googleapis.com/ambassador.rbac.v1.CelMatcher"
+
+func init() {
+	RegisterPermissionMatcher(CELMatcherTypeURL, newCELPermissionMatcher)
+	RegisterPrincipalMatcher(CELMatcherTypeURL, newCELPrincipalMatcher)
+}
+
+var (
+	celEnvOnce sync.Once
+	celEnv     *cel.Env
+	celEnvErr  error
+)
+
+// environment lazily builds the cel.Env request/source/destination/
+// connection attributes are evaluated against, mirroring the shape of
+// Envoy's AttributeContext closely enough for header, path and principal
+// based expressions. The CEL string extension functions (split, substring,
+// ...) are available.
+func environment() (*cel.Env, error) {
+	celEnvOnce.Do(func() {
+		celEnv, celEnvErr = cel.NewEnv(
+			ext.Strings(),
+			cel.Declarations(
+				decls.NewVar("request", decls.NewMapType(decls.String, decls.Dyn)),
+				decls.NewVar("source", decls.NewMapType(decls.String, decls.Dyn)),
+				decls.NewVar("destination", decls.NewMapType(decls.String, decls.Dyn)),
+				decls.NewVar("connection", decls.NewMapType(decls.String, decls.Dyn)),
+			),
+		)
+	})
+	return celEnv, celEnvErr
+}
+
+var (
+	programCacheMu sync.Mutex
+	programCache   = map[string]cel.Program{}
+)
+
+// compile compiles expr to a cel.Program, caching per expression string so
+// that a policy referencing the same expression from multiple places (or
+// re-evaluated across many requests) only pays compilation cost once.
+func compile(expr string) (cel.Program, error) {
+	programCacheMu.Lock()
+	defer programCacheMu.Unlock()
+	if prg, ok := programCache[expr]; ok {
+		return prg, nil
+	}
+	env, err := environment()
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	programCache[expr] = prg
+	return prg, nil
+}
+
+type celMatcher struct {
+	expr string
+	prg  cel.Program
+}
+
+func newCELMatcher(cfg *types.Any) (*celMatcher, error) {
+	expr := string(cfg.GetValue())
+	prg, err := compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("rbaceval: compiling CEL expression %q: %v", expr, err)
+	}
+	return &celMatcher{expr: expr, prg: prg}, nil
+}
+
+func newCELPermissionMatcher(cfg *types.Any) (PermissionMatcher, error) {
+	return newCELMatcher(cfg)
+}
+
+func newCELPrincipalMatcher(cfg *types.Any) (PrincipalMatcher, error) {
+	return newCELMatcher(cfg)
+}
+
+func (m *celMatcher) MatchPermission(req *Request) bool { return m.eval(req) }
+func (m *celMatcher) MatchPrincipal(req *Request) bool  { return m.eval(req) }
+
+func (m *celMatcher) eval(req *Request) bool {
+	out, _, err := m.prg.Eval(celActivation(req))
+	if err != nil {
+		return false
+	}
+	allowed, ok := out.Value().(bool)
+	return ok && allowed
+}
+
+func celActivation(req *Request) map[string]interface{} {
+	headers := make(map[string]interface{}, len(req.Headers))
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"method":  req.Method,
+			"path":    req.Path,
+			"headers": headers,
+		},
+		"source": map[string]interface{}{
+			"principal": req.PrincipalName,
+			"address":   ipString(req.SourceIP),
+			"port":      req.SourcePort,
+		},
+		"destination": map[string]interface{}{
+			"address": ipString(req.DestinationIP),
+			"port":    req.DestinationPort,
+		},
+		"connection": map[string]interface{}{
+			"requested_server_name": req.RequestedServerName,
+		},
+	}
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,136 @@
+package rbaceval
+
+import (
+	"testing"
+
+	rbacconfig "github.com/datawire/ambassador/pkg/api/envoy/config/rbac/v4alpha"
+	matcher "github.com/datawire/ambassador/pkg/api/envoy/type/matcher/v4alpha"
+	"github.com/gogo/protobuf/types"
+
+	rbacv4alpha "github.com/datawire/ambassador/pkg/api/envoy/extensions/filters/http/rbac/v4alpha"
+)
+
+func celPrincipal(expr string) *rbacconfig.Principal {
+	return ExtensionPrincipal(ExtensionConfig{
+		Config: &types.Any{TypeUrl: CELMatcherTypeURL, Value: []byte(expr)},
+	})
+}
+
+func TestCELPrincipalMatcher(t *testing.T) {
+	filter := &rbacv4alpha.RBAC{
+		Rules: &rbacconfig.RBAC{
+			Action: rbacconfig.RBAC_ALLOW,
+			Policies: map[string]*rbacconfig.Policy{
+				"tenant-header-matches-principal": {
+					Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}},
+					Principals: []*rbacconfig.Principal{
+						celPrincipal(`request["headers"]["x-tenant"] == source["principal"]`),
+					},
+				},
+			},
+		},
+	}
+
+	allowed := &Request{
+		Headers:       map[string]string{"x-tenant": "acme"},
+		PrincipalName: "acme",
+	}
+	if got := Evaluate(filter, allowed); got.Decision != Allow {
+		t.Fatalf("Evaluate() = %+v, want Allow", got)
+	}
+
+	denied := &Request{
+		Headers:       map[string]string{"x-tenant": "acme"},
+		PrincipalName: "other",
+	}
+	if got := Evaluate(filter, denied); got.Decision != Deny {
+		t.Fatalf("Evaluate() = %+v, want Deny", got)
+	}
+}
+
+// TestMetadataMatcherNotShadowedByExtension confirms that a genuine
+// Principal.Metadata matcher is unaffected by a registered extension whose
+// type URL happens to equal its Filter: extension dispatch applies only to
+// Metadata matchers whose Filter is the reserved extensionFilter value, so a
+// Filter equal to a registered type URL is still matched literally.
+func TestMetadataMatcherNotShadowedByExtension(t *testing.T) {
+	filter := &rbacv4alpha.RBAC{
+		Rules: &rbacconfig.RBAC{
+			Action: rbacconfig.RBAC_ALLOW,
+			Policies: map[string]*rbacconfig.Policy{
+				"metadata-literal": {
+					Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}},
+					Principals: []*rbacconfig.Principal{{
+						Identifier: &rbacconfig.Principal_Metadata{
+							Metadata: &matcher.MetadataMatcher{
+								Filter: CELMatcherTypeURL,
+								Path:   []*matcher.MetadataMatcher_PathSegment{{Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: "tier"}}},
+								Value: &matcher.ValueMatcher{
+									MatchPattern: &matcher.ValueMatcher_StringMatch{
+										StringMatch: &matcher.StringMatcher{
+											MatchPattern: &matcher.StringMatcher_Exact{Exact: "gold"},
+										},
+									},
+								},
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	req := &Request{Metadata: map[string]map[string]string{
+		CELMatcherTypeURL: {"tier": "gold"},
+	}}
+	if got := Evaluate(filter, req); got.Decision != Allow {
+		t.Fatalf("Evaluate() = %+v, want Allow (literal metadata match, not CEL)", got)
+	}
+}
+
+// TestCELPrincipalMatcherFromParsedConfig confirms a Principal using the
+// extensionFilter Metadata convention reaches the CEL registry even when
+// built without ExtensionPrincipal — i.e. the shape jsonpb/yaml produces
+// when unmarshalling an RBAC policy authored by hand, rather than built by
+// Go code calling ExtensionPrincipal directly.
+func TestCELPrincipalMatcherFromParsedConfig(t *testing.T) {
+	parsed := &rbacconfig.Principal{
+		Identifier: &rbacconfig.Principal_Metadata{
+			Metadata: &matcher.MetadataMatcher{
+				Filter: extensionFilter,
+				Path:   []*matcher.MetadataMatcher_PathSegment{{Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: CELMatcherTypeURL}}},
+				Value: &matcher.ValueMatcher{
+					MatchPattern: &matcher.ValueMatcher_StringMatch{
+						StringMatch: &matcher.StringMatcher{
+							MatchPattern: &matcher.StringMatcher_Exact{
+								Exact: `request["headers"]["x-tenant"] == source["principal"]`,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	filter := &rbacv4alpha.RBAC{
+		Rules: &rbacconfig.RBAC{
+			Action: rbacconfig.RBAC_ALLOW,
+			Policies: map[string]*rbacconfig.Policy{
+				"tenant-header-matches-principal": {
+					Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}},
+					Principals:  []*rbacconfig.Principal{parsed},
+				},
+			},
+		},
+	}
+
+	allowed := &Request{Headers: map[string]string{"x-tenant": "acme"}, PrincipalName: "acme"}
+	if got := Evaluate(filter, allowed); got.Decision != Allow {
+		t.Fatalf("Evaluate() = %+v, want Allow", got)
+	}
+
+	denied := &Request{Headers: map[string]string{"x-tenant": "acme"}, PrincipalName: "other"}
+	if got := Evaluate(filter, denied); got.Decision != Deny {
+		t.Fatalf("Evaluate() = %+v, want Deny", got)
+	}
+}
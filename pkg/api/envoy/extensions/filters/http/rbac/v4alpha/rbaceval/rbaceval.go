@@ -0,0 +1,519 @@
+// Package rbaceval evaluates envoy.extensions.filters.http.rbac.v4alpha.RBAC
+// filter configuration in-process, mirroring the matching semantics of
+// Envoy's RBAC HTTP filter so that Ambassador can decide, test, and
+// pre-validate policies without round-tripping them through Envoy.
+package rbaceval
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	core "github.com/datawire/ambassador/pkg/api/envoy/config/core/v4alpha"
+	rbacconfig "github.com/datawire/ambassador/pkg/api/envoy/config/rbac/v4alpha"
+	route "github.com/datawire/ambassador/pkg/api/envoy/config/route/v4alpha"
+	rbacv4alpha "github.com/datawire/ambassador/pkg/api/envoy/extensions/filters/http/rbac/v4alpha"
+	matcher "github.com/datawire/ambassador/pkg/api/envoy/type/matcher/v4alpha"
+	envoytype "github.com/datawire/ambassador/pkg/api/envoy/type/v4alpha"
+)
+
+// Decision is the outcome of evaluating a Request against an RBAC policy
+// set.
+type Decision int
+
+const (
+	// NoMatch means neither RBAC.Rules nor RBAC.ShadowRules is
+	// configured, so no rule set had an opinion on the request.
+	NoMatch Decision = iota
+	// Allow means a matching policy permits the request.
+	Allow
+	// Deny means a matching policy forbids the request.
+	Deny
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "Allow"
+	case Deny:
+		return "Deny"
+	default:
+		return "NoMatch"
+	}
+}
+
+// Request carries the request attributes that RBAC permissions and
+// principals can be matched against.
+type Request struct {
+	Method  string
+	Path    string
+	Headers map[string]string
+
+	SourceIP        net.IP
+	SourcePort      uint32
+	DestinationIP   net.IP
+	DestinationPort uint32
+
+	// RequestedServerName is the SNI name requested over TLS, if any.
+	RequestedServerName string
+
+	// PrincipalName is the authenticated principal of the connection,
+	// taken from the peer certificate's URI/DNS SAN (or another source
+	// of authentication upstream of the filter). It is matched by
+	// Principal.Authenticated.
+	PrincipalName string
+
+	// Metadata holds the dynamic metadata namespaces a Permission or
+	// Principal's Metadata matcher can be evaluated against, keyed by
+	// filter name and then by metadata key. Values are compared as
+	// strings, which covers the common case of metadata populated by
+	// other HTTP filters (e.g. JWT claims promoted to dynamic metadata).
+	Metadata map[string]map[string]string
+}
+
+// Result is the outcome of Evaluate.
+type Result struct {
+	Decision Decision
+	// Policy is the name of the policy that produced Decision. It is
+	// empty when Decision is NoMatch.
+	Policy string
+	// ShadowOnly is true when no enforced rules (RBAC.Rules) are
+	// configured and the reported Decision/Policy instead came from
+	// evaluating RBAC.ShadowRules for advisory purposes.
+	ShadowOnly bool
+}
+
+// Evaluate decides whether req would be permitted by filter. It evaluates
+// filter.GetRules() first; a configured rule set always has an opinion (a
+// matching policy's action, or the opposite of its action when no policy
+// matches). Only when filter.Rules is nil is filter.GetShadowRules()
+// evaluated as a fallback so that shadow-only policies are still
+// observable, with Result.ShadowOnly set to true.
+//
+// Evaluate compiles filter on every call; for repeated evaluation against
+// the same filter (the common case — a filter is loaded once and evaluated
+// per request), call Compile once up front and reuse the *CompiledRBAC
+// instead, so the per-policy-set preparation done by Compile isn't repeated
+// on every request.
+func Evaluate(filter *rbacv4alpha.RBAC, req *Request) Result {
+	return Compile(filter).Evaluate(req)
+}
+
+// CompiledRBAC is an *rbacv4alpha.RBAC prepared for repeated evaluation:
+// policy names are pre-sorted and any extension matchers declared via the
+// extensionFilter Metadata convention (see RegisterPermissionMatcher) are
+// pre-resolved, keyed only for the lifetime of this value — nothing is
+// retained in package-level state, so a CompiledRBAC for a superseded
+// config generation is reclaimed by the garbage collector like any other
+// value once the caller drops it. Recompile when filter changes.
+type CompiledRBAC struct {
+	filter *rbacv4alpha.RBAC
+
+	rulesNames, shadowNames []string
+
+	permissionExt map[*rbacconfig.Permission]PermissionMatcher
+	principalExt  map[*rbacconfig.Principal]PrincipalMatcher
+}
+
+// Compile prepares filter for repeated evaluation. See CompiledRBAC.
+func Compile(filter *rbacv4alpha.RBAC) *CompiledRBAC {
+	c := &CompiledRBAC{
+		filter:        filter,
+		rulesNames:    sortedPolicyNames(filter.GetRules().GetPolicies()),
+		shadowNames:   sortedPolicyNames(filter.GetShadowRules().GetPolicies()),
+		permissionExt: map[*rbacconfig.Permission]PermissionMatcher{},
+		principalExt:  map[*rbacconfig.Principal]PrincipalMatcher{},
+	}
+	c.resolveExtensions(filter.GetRules())
+	c.resolveExtensions(filter.GetShadowRules())
+	return c
+}
+
+// resolveExtensions walks every Permission/Principal in rules, pre-building
+// the matcher for any that use the extensionFilter convention so Evaluate
+// doesn't repeat registry lookups or matcher construction per request.
+func (c *CompiledRBAC) resolveExtensions(rules *rbacconfig.RBAC) {
+	for _, p := range rules.GetPolicies() {
+		for _, perm := range p.GetPermissions() {
+			c.resolvePermission(perm)
+		}
+		for _, principal := range p.GetPrincipals() {
+			c.resolvePrincipal(principal)
+		}
+	}
+}
+
+func (c *CompiledRBAC) resolvePermission(perm *rbacconfig.Permission) {
+	switch {
+	case perm == nil:
+		return
+	case perm.GetAndRules() != nil:
+		for _, r := range perm.GetAndRules().GetRules() {
+			c.resolvePermission(r)
+		}
+	case perm.GetOrRules() != nil:
+		for _, r := range perm.GetOrRules().GetRules() {
+			c.resolvePermission(r)
+		}
+	case perm.GetNotRule() != nil:
+		c.resolvePermission(perm.GetNotRule())
+	case perm.GetMetadata() != nil:
+		cfg, ok := extensionConfigFromMetadata(perm.GetMetadata())
+		if !ok {
+			return
+		}
+		if m, err := buildPermissionMatcher(cfg.Config.GetTypeUrl(), cfg.Config); err == nil {
+			c.permissionExt[perm] = m
+		}
+	}
+}
+
+func (c *CompiledRBAC) resolvePrincipal(principal *rbacconfig.Principal) {
+	switch {
+	case principal == nil:
+		return
+	case principal.GetAndIds() != nil:
+		for _, id := range principal.GetAndIds().GetIds() {
+			c.resolvePrincipal(id)
+		}
+	case principal.GetOrIds() != nil:
+		for _, id := range principal.GetOrIds().GetIds() {
+			c.resolvePrincipal(id)
+		}
+	case principal.GetNotId() != nil:
+		c.resolvePrincipal(principal.GetNotId())
+	case principal.GetMetadata() != nil:
+		cfg, ok := extensionConfigFromMetadata(principal.GetMetadata())
+		if !ok {
+			return
+		}
+		if m, err := buildPrincipalMatcher(cfg.Config.GetTypeUrl(), cfg.Config); err == nil {
+			c.principalExt[principal] = m
+		}
+	}
+}
+
+// Evaluate decides whether req would be permitted by the filter c was
+// compiled from. See the package-level Evaluate for the one-shot form.
+func (c *CompiledRBAC) Evaluate(req *Request) Result {
+	if decision, policy, ok := c.evaluateRules(c.filter.GetRules(), c.rulesNames, req); ok {
+		return Result{Decision: decision, Policy: policy}
+	}
+	if decision, policy, ok := c.evaluateRules(c.filter.GetShadowRules(), c.shadowNames, req); ok {
+		return Result{Decision: decision, Policy: policy, ShadowOnly: true}
+	}
+	return Result{Decision: NoMatch}
+}
+
+// evaluateRules reports whether rules produced an opinion (true whenever
+// rules is non-nil) along with the resulting decision and the matched policy
+// name, which is empty when the decision is the rule set's default. names
+// must be rules.GetPolicies()'s keys, pre-sorted by Compile.
+func (c *CompiledRBAC) evaluateRules(rules *rbacconfig.RBAC, names []string, req *Request) (decision Decision, policy string, matched bool) {
+	if rules == nil {
+		return NoMatch, "", false
+	}
+
+	for _, name := range names {
+		p := rules.GetPolicies()[name]
+		if c.matchesPolicy(p, req) {
+			if rules.GetAction() == rbacconfig.RBAC_ALLOW {
+				return Allow, name, true
+			}
+			return Deny, name, true
+		}
+	}
+
+	// No policy matched. Under ALLOW, that means deny-by-default; under
+	// DENY, it means allow-by-default. Either way the rule set did
+	// produce an opinion, just not via a named policy.
+	if rules.GetAction() == rbacconfig.RBAC_ALLOW {
+		return Deny, "", true
+	}
+	return Allow, "", true
+}
+
+// sortedPolicyNames returns policy names in a deterministic order. Policies
+// is a proto map, which Go (and Envoy) intentionally give no iteration
+// order; sorting keeps Evaluate's reported "matched policy" stable across
+// calls and tests. Compile calls this once per rule set rather than
+// Evaluate calling it once per request.
+func sortedPolicyNames(policies map[string]*rbacconfig.Policy) []string {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matchesPolicy implements Envoy's Policy contract: a policy matches if and
+// only if at least one of its Permissions matches and at least one of its
+// Principals matches, i.e. the entries within each list are OR'd and the
+// two lists are AND'd together.
+func (c *CompiledRBAC) matchesPolicy(p *rbacconfig.Policy, req *Request) bool {
+	if p == nil {
+		return false
+	}
+	permissionMatch := false
+	for _, perm := range p.GetPermissions() {
+		if c.matchPermission(perm, req) {
+			permissionMatch = true
+			break
+		}
+	}
+	if !permissionMatch {
+		return false
+	}
+	for _, principal := range p.GetPrincipals() {
+		if c.matchPrincipal(principal, req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CompiledRBAC) matchPermission(perm *rbacconfig.Permission, req *Request) bool {
+	if perm == nil {
+		return false
+	}
+	if m, ok := c.permissionExt[perm]; ok {
+		return m.MatchPermission(req)
+	}
+	switch {
+	case perm.GetAny():
+		return true
+	case perm.GetAndRules() != nil:
+		for _, r := range perm.GetAndRules().GetRules() {
+			if !c.matchPermission(r, req) {
+				return false
+			}
+		}
+		return true
+	case perm.GetOrRules() != nil:
+		for _, r := range perm.GetOrRules().GetRules() {
+			if c.matchPermission(r, req) {
+				return true
+			}
+		}
+		return false
+	case perm.GetNotRule() != nil:
+		return !c.matchPermission(perm.GetNotRule(), req)
+	case perm.GetHeader() != nil:
+		return matchHeader(perm.GetHeader(), req)
+	case perm.GetUrlPath() != nil:
+		return matchPathMatcher(perm.GetUrlPath(), req.Path)
+	case perm.GetDestinationPortRange() != nil:
+		return matchPortRange(perm.GetDestinationPortRange(), req.DestinationPort)
+	case perm.GetMetadata() != nil:
+		return matchMetadata(perm.GetMetadata(), req)
+	default:
+		return false
+	}
+}
+
+func (c *CompiledRBAC) matchPrincipal(principal *rbacconfig.Principal, req *Request) bool {
+	if principal == nil {
+		return false
+	}
+	if m, ok := c.principalExt[principal]; ok {
+		return m.MatchPrincipal(req)
+	}
+	switch {
+	case principal.GetAny():
+		return true
+	case principal.GetAndIds() != nil:
+		for _, id := range principal.GetAndIds().GetIds() {
+			if !c.matchPrincipal(id, req) {
+				return false
+			}
+		}
+		return true
+	case principal.GetOrIds() != nil:
+		for _, id := range principal.GetOrIds().GetIds() {
+			if c.matchPrincipal(id, req) {
+				return true
+			}
+		}
+		return false
+	case principal.GetNotId() != nil:
+		return !c.matchPrincipal(principal.GetNotId(), req)
+	case principal.GetAuthenticated() != nil:
+		name := principal.GetAuthenticated().GetPrincipalName()
+		if name == nil {
+			return req.PrincipalName != ""
+		}
+		return matchStringMatcher(name, req.PrincipalName)
+	case principal.GetRemoteIp() != nil:
+		return matchCIDR(principal.GetRemoteIp(), req.SourceIP)
+	case principal.GetDirectRemoteIp() != nil:
+		return matchCIDR(principal.GetDirectRemoteIp(), req.SourceIP)
+	case principal.GetHeader() != nil:
+		return matchHeader(principal.GetHeader(), req)
+	case principal.GetUrlPath() != nil:
+		return matchPathMatcher(principal.GetUrlPath(), req.Path)
+	case principal.GetMetadata() != nil:
+		return matchMetadata(principal.GetMetadata(), req)
+	default:
+		return false
+	}
+}
+
+var (
+	regexCacheMu sync.Mutex
+	regexCache   = map[string]*regexp.Regexp{}
+)
+
+// compileRegex compiles pattern to a *regexp.Regexp, caching per pattern
+// string so a matcher referencing the same regex from multiple places (or
+// re-evaluated across many requests) only pays compilation cost once,
+// mirroring cel.go's compile().
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexCacheMu.Lock()
+	defer regexCacheMu.Unlock()
+	if re, ok := regexCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache[pattern] = re
+	return re, nil
+}
+
+// matchRegex reports whether value matches m, returning false (rather than
+// panicking or silently degrading to a different rule) if m's pattern fails
+// to compile — an invalid regex should never be reinterpreted as "always"
+// or "never" in a way that's hard to tell apart from a deliberate policy.
+func matchRegex(m *matcher.RegexMatcher, value string) bool {
+	re, err := compileRegex(m.GetRegex())
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+func matchHeader(h *route.HeaderMatcher, req *Request) bool {
+	value, present := req.Headers[h.GetName()]
+	var match bool
+	switch {
+	case h.GetPresentMatch():
+		match = present
+	case !present:
+		match = false
+	case h.GetExactMatch() != "":
+		match = value == h.GetExactMatch()
+	case h.GetPrefixMatch() != "":
+		match = strings.HasPrefix(value, h.GetPrefixMatch())
+	case h.GetSuffixMatch() != "":
+		match = strings.HasSuffix(value, h.GetSuffixMatch())
+	case h.GetContainsMatch() != "":
+		match = strings.Contains(value, h.GetContainsMatch())
+	case h.GetSafeRegexMatch() != nil:
+		match = matchRegex(h.GetSafeRegexMatch(), value)
+	case h.GetRangeMatch() != nil:
+		n, err := strconv.ParseInt(value, 10, 64)
+		match = err == nil && matchInt64Range(h.GetRangeMatch(), n)
+	default:
+		match = present
+	}
+	if h.GetInvertMatch() {
+		return !match
+	}
+	return match
+}
+
+func matchPathMatcher(p *matcher.PathMatcher, path string) bool {
+	if p == nil {
+		return false
+	}
+	return matchStringMatcher(p.GetPath(), path)
+}
+
+func matchStringMatcher(m *matcher.StringMatcher, value string) bool {
+	if m == nil {
+		return false
+	}
+	if m.GetSafeRegex() != nil {
+		// Regexes are matched against the raw value: ignore_case and
+		// regex are mutually exclusive in Envoy's StringMatcher, and
+		// the pattern itself is responsible for any case-folding.
+		return matchRegex(m.GetSafeRegex(), value)
+	}
+	lower := func(s string) string {
+		if m.GetIgnoreCase() {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	value = lower(value)
+	switch {
+	case m.GetExact() != "":
+		return value == lower(m.GetExact())
+	case m.GetPrefix() != "":
+		return strings.HasPrefix(value, lower(m.GetPrefix()))
+	case m.GetSuffix() != "":
+		return strings.HasSuffix(value, lower(m.GetSuffix()))
+	case m.GetContains() != "":
+		return strings.Contains(value, lower(m.GetContains()))
+	default:
+		return false
+	}
+}
+
+func matchPortRange(r *rbacconfig.Permission_PortRange, port uint32) bool {
+	if r == nil {
+		return false
+	}
+	return port >= r.GetStart() && port < r.GetEnd()
+}
+
+func matchInt64Range(r *envoytype.Int64Range, n int64) bool {
+	if r == nil {
+		return false
+	}
+	return n >= r.GetStart() && n < r.GetEnd()
+}
+
+func matchCIDR(cidr *core.CidrRange, ip net.IP) bool {
+	if cidr == nil || ip == nil {
+		return false
+	}
+	prefixLen := int(cidr.GetPrefixLen().GetValue())
+	_, network, err := net.ParseCIDR(cidr.GetAddressPrefix() + "/" + strconv.Itoa(prefixLen))
+	if err != nil {
+		return false
+	}
+	return network.Contains(ip)
+}
+
+// matchMetadata implements Metadata matching against req.Metadata's flat
+// filter-name/key namespace (see Request.Metadata). Envoy's Path can in
+// principle carry multiple segments to address a value nested inside a
+// struct, but Request.Metadata only models a single level of keys per
+// filter, so there is no segment Path's second-and-later entries could
+// correctly address; rather than best-effort scanning the flat map for any
+// segment that happens to exist (and risk matching an unrelated key), a
+// multi-segment Path is treated as not matching.
+func matchMetadata(m *matcher.MetadataMatcher, req *Request) bool {
+	if m == nil || req.Metadata == nil {
+		return false
+	}
+	path := m.GetPath()
+	if len(path) != 1 {
+		return false
+	}
+	ns, ok := req.Metadata[m.GetFilter()]
+	if !ok {
+		return false
+	}
+	value, ok := ns[path[0].GetKey()]
+	if !ok {
+		return false
+	}
+	return matchStringMatcher(m.GetValue().GetStringMatch(), value)
+}
@@ -0,0 +1,301 @@
+package rbaceval
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	core "github.com/datawire/ambassador/pkg/api/envoy/config/core/v4alpha"
+	rbacconfig "github.com/datawire/ambassador/pkg/api/envoy/config/rbac/v4alpha"
+	route "github.com/datawire/ambassador/pkg/api/envoy/config/route/v4alpha"
+	matcher "github.com/datawire/ambassador/pkg/api/envoy/type/matcher/v4alpha"
+	envoytype "github.com/datawire/ambassador/pkg/api/envoy/type/v4alpha"
+	"github.com/gogo/protobuf/types"
+
+	rbacv4alpha "github.com/datawire/ambassador/pkg/api/envoy/extensions/filters/http/rbac/v4alpha"
+)
+
+func policyWithHeader(action rbacconfig.RBAC_Action, name, header, exact string) *rbacv4alpha.RBAC {
+	return &rbacv4alpha.RBAC{
+		Rules: &rbacconfig.RBAC{
+			Action: action,
+			Policies: map[string]*rbacconfig.Policy{
+				name: {
+					Permissions: []*rbacconfig.Permission{
+						{Rule: &rbacconfig.Permission_Any{Any: true}},
+					},
+					Principals: []*rbacconfig.Principal{
+						{
+							Identifier: &rbacconfig.Principal_Header{
+								Header: &route.HeaderMatcher{
+									Name: header,
+									HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{
+										ExactMatch: exact,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+var goldenCases = []struct {
+	name   string
+	filter *rbacv4alpha.RBAC
+	req    *Request
+	want   Result
+}{
+	{
+		name:   "allow policy matches",
+		filter: policyWithHeader(rbacconfig.RBAC_ALLOW, "allow-admins", "x-role", "admin"),
+		req:    &Request{Headers: map[string]string{"x-role": "admin"}},
+		want:   Result{Decision: Allow, Policy: "allow-admins"},
+	},
+	{
+		name:   "allow policy does not match, default deny",
+		filter: policyWithHeader(rbacconfig.RBAC_ALLOW, "allow-admins", "x-role", "admin"),
+		req:    &Request{Headers: map[string]string{"x-role": "guest"}},
+		want:   Result{Decision: Deny},
+	},
+	{
+		name:   "deny policy matches",
+		filter: policyWithHeader(rbacconfig.RBAC_DENY, "deny-banned", "x-role", "banned"),
+		req:    &Request{Headers: map[string]string{"x-role": "banned"}},
+		want:   Result{Decision: Deny, Policy: "deny-banned"},
+	},
+	{
+		name:   "deny policy does not match, default allow",
+		filter: policyWithHeader(rbacconfig.RBAC_DENY, "deny-banned", "x-role", "banned"),
+		req:    &Request{Headers: map[string]string{"x-role": "guest"}},
+		want:   Result{Decision: Allow},
+	},
+	{
+		name:   "no rules configured",
+		filter: &rbacv4alpha.RBAC{},
+		req:    &Request{},
+		want:   Result{Decision: NoMatch},
+	},
+	{
+		name: "shadow-only match surfaces shadow decision",
+		filter: &rbacv4alpha.RBAC{
+			ShadowRules: policyWithHeader(rbacconfig.RBAC_ALLOW, "shadow-admins", "x-role", "admin").GetRules(),
+		},
+		req:  &Request{Headers: map[string]string{"x-role": "admin"}},
+		want: Result{Decision: Allow, Policy: "shadow-admins", ShadowOnly: true},
+	},
+	{
+		name: "policy matches if any permission and any principal match",
+		filter: &rbacv4alpha.RBAC{
+			Rules: &rbacconfig.RBAC{
+				Action: rbacconfig.RBAC_ALLOW,
+				Policies: map[string]*rbacconfig.Policy{
+					"get-or-post": {
+						Permissions: []*rbacconfig.Permission{
+							{
+								Rule: &rbacconfig.Permission_Header{
+									Header: &route.HeaderMatcher{
+										Name:                 ":method",
+										HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "GET"},
+									},
+								},
+							},
+							{
+								Rule: &rbacconfig.Permission_Header{
+									Header: &route.HeaderMatcher{
+										Name:                 ":method",
+										HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "POST"},
+									},
+								},
+							},
+						},
+						Principals: []*rbacconfig.Principal{
+							{
+								Identifier: &rbacconfig.Principal_Header{
+									Header: &route.HeaderMatcher{
+										Name:                 "x-role",
+										HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "admin"},
+									},
+								},
+							},
+							{
+								Identifier: &rbacconfig.Principal_Header{
+									Header: &route.HeaderMatcher{
+										Name:                 "x-role",
+										HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "operator"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		req: &Request{Headers: map[string]string{
+			":method": "POST",
+			"x-role":  "operator",
+		}},
+		want: Result{Decision: Allow, Policy: "get-or-post"},
+	},
+	{
+		name: "remote ip principal",
+		filter: &rbacv4alpha.RBAC{
+			Rules: &rbacconfig.RBAC{
+				Action: rbacconfig.RBAC_ALLOW,
+				Policies: map[string]*rbacconfig.Policy{
+					"internal": {
+						Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}},
+						Principals: []*rbacconfig.Principal{{
+							Identifier: &rbacconfig.Principal_RemoteIp{
+								RemoteIp: &core.CidrRange{AddressPrefix: "10.0.0.0", PrefixLen: &types.UInt32Value{Value: 8}},
+							},
+						}},
+					},
+				},
+			},
+		},
+		req:  &Request{SourceIP: net.ParseIP("10.1.2.3")},
+		want: Result{Decision: Allow, Policy: "internal"},
+	},
+}
+
+func TestEvaluateGolden(t *testing.T) {
+	for _, tc := range goldenCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Evaluate(tc.filter, tc.req)
+			if got != tc.want {
+				t.Fatalf("Evaluate() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func BenchmarkEvaluateLargePolicySet(b *testing.B) {
+	policies := make(map[string]*rbacconfig.Policy, 1000)
+	for i := 0; i < 1000; i++ {
+		name := "policy-" + strconv.Itoa(i)
+		policies[name] = &rbacconfig.Policy{
+			Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}},
+			Principals: []*rbacconfig.Principal{{
+				Identifier: &rbacconfig.Principal_Header{
+					Header: &route.HeaderMatcher{
+						Name:                 "x-tenant",
+						HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: name},
+					},
+				},
+			}},
+		}
+	}
+	filter := &rbacv4alpha.RBAC{
+		Rules: &rbacconfig.RBAC{Action: rbacconfig.RBAC_ALLOW, Policies: policies},
+	}
+	req := &Request{Headers: map[string]string{"x-tenant": "policy-999"}}
+
+	compiled := Compile(filter)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compiled.Evaluate(req)
+	}
+}
+
+// TestMatchHeaderSafeRegexAndRange covers the header matcher kinds that
+// degrade silently (to "header present" and "never matches" respectively)
+// when not implemented: safe_regex_match and range_match.
+func TestMatchHeaderSafeRegexAndRange(t *testing.T) {
+	cases := []struct {
+		name   string
+		header *route.HeaderMatcher
+		value  string
+		want   bool
+	}{
+		{
+			name: "safe_regex_match matches",
+			header: &route.HeaderMatcher{
+				Name:                 "x-request-id",
+				HeaderMatchSpecifier: &route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: &matcher.RegexMatcher{Regex: `^[0-9a-f]{8}$`}},
+			},
+			value: "deadbeef",
+			want:  true,
+		},
+		{
+			name: "safe_regex_match does not match",
+			header: &route.HeaderMatcher{
+				Name:                 "x-request-id",
+				HeaderMatchSpecifier: &route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: &matcher.RegexMatcher{Regex: `^[0-9a-f]{8}$`}},
+			},
+			value: "not-hex",
+			want:  false,
+		},
+		{
+			name: "range_match matches",
+			header: &route.HeaderMatcher{
+				Name:                 "content-length",
+				HeaderMatchSpecifier: &route.HeaderMatcher_RangeMatch{RangeMatch: &envoytype.Int64Range{Start: 0, End: 1024}},
+			},
+			value: "512",
+			want:  true,
+		},
+		{
+			name: "range_match out of range",
+			header: &route.HeaderMatcher{
+				Name:                 "content-length",
+				HeaderMatchSpecifier: &route.HeaderMatcher_RangeMatch{RangeMatch: &envoytype.Int64Range{Start: 0, End: 1024}},
+			},
+			value: "2048",
+			want:  false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &Request{Headers: map[string]string{tc.header.GetName(): tc.value}}
+			if got := matchHeader(tc.header, req); got != tc.want {
+				t.Fatalf("matchHeader() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestMatchStringMatcherSafeRegex covers StringMatcher.safe_regex, which
+// otherwise falls through matchStringMatcher's default case and never
+// matches — used by UrlPath, Principal.Authenticated.principal_name, and
+// Metadata.Value.
+func TestMatchStringMatcherSafeRegex(t *testing.T) {
+	m := &matcher.StringMatcher{
+		MatchPattern: &matcher.StringMatcher_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{Regex: `^spiffe://cluster\.local/ns/[^/]+/sa/admin$`},
+		},
+	}
+	if !matchStringMatcher(m, "spiffe://cluster.local/ns/default/sa/admin") {
+		t.Fatal("matchStringMatcher() = false, want true")
+	}
+	if matchStringMatcher(m, "spiffe://cluster.local/ns/default/sa/guest") {
+		t.Fatal("matchStringMatcher() = true, want false")
+	}
+}
+
+// TestMatchMetadataRejectsMultiSegmentPath confirms that a Metadata matcher
+// whose Path has more than one segment is treated as not matching, rather
+// than best-effort scanning the flat Request.Metadata namespace for the
+// first segment that happens to be present there (see matchMetadata).
+func TestMatchMetadataRejectsMultiSegmentPath(t *testing.T) {
+	m := &matcher.MetadataMatcher{
+		Filter: "envoy.filters.http.jwt_authn",
+		Path: []*matcher.MetadataMatcher_PathSegment{
+			{Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: "claims"}},
+			{Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: "tier"}},
+		},
+		Value: &matcher.ValueMatcher{
+			MatchPattern: &matcher.ValueMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: "gold"}},
+			},
+		},
+	}
+	req := &Request{Metadata: map[string]map[string]string{
+		"envoy.filters.http.jwt_authn": {"claims": "unrelated-value", "tier": "gold"},
+	}}
+	if matchMetadata(m, req) {
+		t.Fatal("matchMetadata() = true, want false for multi-segment Path")
+	}
+}
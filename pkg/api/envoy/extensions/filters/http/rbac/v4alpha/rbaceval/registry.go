@@ -0,0 +1,152 @@
+package rbaceval
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gogo/protobuf/types"
+
+	rbacconfig "github.com/datawire/ambassador/pkg/api/envoy/config/rbac/v4alpha"
+	matcher "github.com/datawire/ambassador/pkg/api/envoy/type/matcher/v4alpha"
+)
+
+// PermissionMatcher is implemented by custom permission matchers registered
+// via RegisterPermissionMatcher.
+type PermissionMatcher interface {
+	MatchPermission(req *Request) bool
+}
+
+// PrincipalMatcher is implemented by custom principal matchers registered
+// via RegisterPrincipalMatcher.
+type PrincipalMatcher interface {
+	MatchPrincipal(req *Request) bool
+}
+
+// PermissionMatcherFactory builds a PermissionMatcher from the typed config
+// carried by an ExtensionConfig registered under the same type URL.
+type PermissionMatcherFactory func(*types.Any) (PermissionMatcher, error)
+
+// PrincipalMatcherFactory builds a PrincipalMatcher from the typed config
+// carried by an ExtensionConfig registered under the same type URL.
+type PrincipalMatcherFactory func(*types.Any) (PrincipalMatcher, error)
+
+var (
+	registryMu         sync.RWMutex
+	permissionMatchers = map[string]PermissionMatcherFactory{}
+	principalMatchers  = map[string]PrincipalMatcherFactory{}
+)
+
+// RegisterPermissionMatcher makes factory available for permission entries
+// extended via ExtensionPermission whose Config's type URL equals typeURL,
+// letting downstream Ambassador code add project-specific permission
+// matchers without modifying the generated RBAC messages. Typically called
+// from an init function.
+func RegisterPermissionMatcher(typeURL string, factory PermissionMatcherFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	permissionMatchers[typeURL] = factory
+}
+
+// RegisterPrincipalMatcher makes factory available for principal entries
+// extended via ExtensionPrincipal whose Config's type URL equals typeURL.
+// Typically called from an init function.
+func RegisterPrincipalMatcher(typeURL string, factory PrincipalMatcherFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	principalMatchers[typeURL] = factory
+}
+
+func buildPermissionMatcher(typeURL string, cfg *types.Any) (PermissionMatcher, error) {
+	registryMu.RLock()
+	factory, ok := permissionMatchers[typeURL]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("rbaceval: no permission matcher registered for type %q", typeURL)
+	}
+	return factory(cfg)
+}
+
+func buildPrincipalMatcher(typeURL string, cfg *types.Any) (PrincipalMatcher, error) {
+	registryMu.RLock()
+	factory, ok := principalMatchers[typeURL]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("rbaceval: no principal matcher registered for type %q", typeURL)
+	}
+	return factory(cfg)
+}
+
+// ExtensionConfig identifies a custom Permission or Principal matcher,
+// mirroring the (name, typed_config) shape of Envoy's
+// core.TypedExtensionConfig: Config's type URL is looked up in the registry
+// to find the factory that builds the matcher, and Config itself is handed
+// to that factory.
+type ExtensionConfig struct {
+	Name   string
+	Config *types.Any
+}
+
+// extensionFilter is the reserved Metadata.Filter value that marks a
+// Permission/Principal's Metadata matcher as extension dispatch rather than
+// literal dynamic-metadata matching. Real dynamic metadata is always
+// populated under a filter's own canonical name (e.g.
+// "envoy.filters.http.jwt_authn"), which will never equal this sentinel, so
+// the convention is safe to apply uniformly to every Metadata matcher
+// Compile sees — whether it was built by hand via ExtensionPermission/
+// ExtensionPrincipal or parsed from a YAML/JSON-authored policy (see
+// rbacjson), letting both reach the same registry. See Compile.
+const extensionFilter = "type.googleapis.com/ambassador.rbac.v1.Extension"
+
+// extensionMetadataMatcher encodes cfg as a Metadata matcher under the
+// extensionFilter convention: the extension's type URL is carried as the
+// sole Path segment's key, and its serialized config as Value's
+// string_match.exact.
+func extensionMetadataMatcher(cfg ExtensionConfig) *matcher.MetadataMatcher {
+	return &matcher.MetadataMatcher{
+		Filter: extensionFilter,
+		Path: []*matcher.MetadataMatcher_PathSegment{{
+			Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: cfg.Config.GetTypeUrl()},
+		}},
+		Value: &matcher.ValueMatcher{
+			MatchPattern: &matcher.ValueMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{Exact: string(cfg.Config.GetValue())},
+				},
+			},
+		},
+	}
+}
+
+// extensionConfigFromMetadata reverses extensionMetadataMatcher, reporting
+// ok=false for any Metadata matcher that isn't using the extensionFilter
+// convention (i.e. every genuine dynamic-metadata matcher).
+func extensionConfigFromMetadata(m *matcher.MetadataMatcher) (ExtensionConfig, bool) {
+	if m.GetFilter() != extensionFilter {
+		return ExtensionConfig{}, false
+	}
+	path := m.GetPath()
+	if len(path) != 1 {
+		return ExtensionConfig{}, false
+	}
+	typeURL := path[0].GetKey()
+	if typeURL == "" {
+		return ExtensionConfig{}, false
+	}
+	expr := m.GetValue().GetStringMatch().GetExact()
+	return ExtensionConfig{Config: &types.Any{TypeUrl: typeURL, Value: []byte(expr)}}, true
+}
+
+// ExtensionPermission returns a Permission entry evaluated by the
+// PermissionMatcher registered for cfg.Config's type URL, rather than by
+// any of the built-in Permission.Rule cases. It is implemented via the
+// extensionFilter Metadata convention, so it round-trips through rbacjson
+// and a YAML-authored policy using that same convention reaches the
+// registry identically — see Compile.
+func ExtensionPermission(cfg ExtensionConfig) *rbacconfig.Permission {
+	return &rbacconfig.Permission{Rule: &rbacconfig.Permission_Metadata{Metadata: extensionMetadataMatcher(cfg)}}
+}
+
+// ExtensionPrincipal is the Principal equivalent of ExtensionPermission.
+func ExtensionPrincipal(cfg ExtensionConfig) *rbacconfig.Principal {
+	return &rbacconfig.Principal{Identifier: &rbacconfig.Principal_Metadata{Metadata: extensionMetadataMatcher(cfg)}}
+}
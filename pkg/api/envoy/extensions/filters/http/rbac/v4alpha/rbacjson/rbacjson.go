@@ -0,0 +1,99 @@
+// Package rbacjson provides Envoy-compatible proto3 JSON and YAML
+// round-tripping for the envoy.extensions.filters.http.rbac.v4alpha RBAC and
+// RBACPerRoute filter messages.
+//
+// The generated RBAC/RBACPerRoute types are gogo/protobuf messages, so
+// encoding/json would marshal them using their Go field names (Rules,
+// ShadowRules, ...) instead of Envoy's canonical lower_camel_case proto3
+// JSON, and would not know how to discriminate the oneof fields or Any
+// values nested inside the embedded v4alpha.RBAC. This package goes through
+// gogo/protobuf/jsonpb instead, which already implements that mapping, and
+// adds a YAML front-end so RBAC snippets copied from Envoy's documentation
+// can be loaded directly.
+package rbacjson
+
+import (
+	"strings"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"sigs.k8s.io/yaml"
+
+	rbacv4alpha "github.com/datawire/ambassador/pkg/api/envoy/extensions/filters/http/rbac/v4alpha"
+)
+
+var marshaler = &jsonpb.Marshaler{OrigName: false}
+
+// MarshalRBAC encodes m as Envoy-canonical proto3 JSON.
+func MarshalRBAC(m *rbacv4alpha.RBAC) ([]byte, error) {
+	s, err := marshaler.MarshalToString(m)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// UnmarshalRBAC decodes Envoy-canonical proto3 JSON into m.
+func UnmarshalRBAC(data []byte, m *rbacv4alpha.RBAC) error {
+	return jsonpb.Unmarshal(strings.NewReader(string(data)), m)
+}
+
+// MarshalRBACPerRoute encodes m as Envoy-canonical proto3 JSON.
+func MarshalRBACPerRoute(m *rbacv4alpha.RBACPerRoute) ([]byte, error) {
+	s, err := marshaler.MarshalToString(m)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// UnmarshalRBACPerRoute decodes Envoy-canonical proto3 JSON into m.
+func UnmarshalRBACPerRoute(data []byte, m *rbacv4alpha.RBACPerRoute) error {
+	return jsonpb.Unmarshal(strings.NewReader(string(data)), m)
+}
+
+// RBACFromYAML converts a YAML-authored RBAC filter snippet (the form users
+// copy out of Envoy's documentation) to proto.
+func RBACFromYAML(y []byte) (*rbacv4alpha.RBAC, error) {
+	js, err := yaml.YAMLToJSON(y)
+	if err != nil {
+		return nil, err
+	}
+	m := &rbacv4alpha.RBAC{}
+	if err := UnmarshalRBAC(js, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RBACToYAML converts m back to the YAML form accepted by RBACFromYAML.
+func RBACToYAML(m *rbacv4alpha.RBAC) ([]byte, error) {
+	js, err := MarshalRBAC(m)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(js)
+}
+
+// RBACPerRouteFromYAML converts a YAML-authored RBACPerRoute snippet to
+// proto.
+func RBACPerRouteFromYAML(y []byte) (*rbacv4alpha.RBACPerRoute, error) {
+	js, err := yaml.YAMLToJSON(y)
+	if err != nil {
+		return nil, err
+	}
+	m := &rbacv4alpha.RBACPerRoute{}
+	if err := UnmarshalRBACPerRoute(js, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RBACPerRouteToYAML converts m back to the YAML form accepted by
+// RBACPerRouteFromYAML.
+func RBACPerRouteToYAML(m *rbacv4alpha.RBACPerRoute) ([]byte, error) {
+	js, err := MarshalRBACPerRoute(m)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(js)
+}
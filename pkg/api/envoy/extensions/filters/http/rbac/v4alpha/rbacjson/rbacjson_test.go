@@ -0,0 +1,223 @@
+package rbacjson
+
+import (
+	"testing"
+	"testing/quick"
+
+	core "github.com/datawire/ambassador/pkg/api/envoy/config/core/v4alpha"
+	rbacconfig "github.com/datawire/ambassador/pkg/api/envoy/config/rbac/v4alpha"
+	route "github.com/datawire/ambassador/pkg/api/envoy/config/route/v4alpha"
+	matcher "github.com/datawire/ambassador/pkg/api/envoy/type/matcher/v4alpha"
+	"github.com/gogo/protobuf/types"
+
+	rbacv4alpha "github.com/datawire/ambassador/pkg/api/envoy/extensions/filters/http/rbac/v4alpha"
+)
+
+// metadataMatcher builds a Metadata matcher for the given filter/key/exact
+// value, used to exercise Metadata's nested oneof fields below.
+func metadataMatcher(filter, key, exact string) *matcher.MetadataMatcher {
+	return &matcher.MetadataMatcher{
+		Filter: filter,
+		Path:   []*matcher.MetadataMatcher_PathSegment{{Segment: &matcher.MetadataMatcher_PathSegment_Key{Key: key}}},
+		Value: &matcher.ValueMatcher{
+			MatchPattern: &matcher.ValueMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{Exact: exact},
+				},
+			},
+		},
+	}
+}
+
+// policyWithTree builds a Policy whose Permissions/Principals exercise the
+// oneof cases that matter for JSON fidelity: and/or/not composition, a
+// plain Header leaf, and a Metadata leaf carrying a oneof-typed value.
+func policyWithTree() *rbacconfig.Policy {
+	return &rbacconfig.Policy{
+		Permissions: []*rbacconfig.Permission{
+			{
+				Rule: &rbacconfig.Permission_OrRules{
+					OrRules: &rbacconfig.Permission_Set{
+						Rules: []*rbacconfig.Permission{
+							{
+								Rule: &rbacconfig.Permission_Header{
+									Header: &route.HeaderMatcher{
+										Name:                 ":method",
+										HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "GET"},
+									},
+								},
+							},
+							{
+								Rule: &rbacconfig.Permission_NotRule{
+									NotRule: &rbacconfig.Permission{Rule: &rbacconfig.Permission_Any{Any: true}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Principals: []*rbacconfig.Principal{
+			{
+				Identifier: &rbacconfig.Principal_AndIds{
+					AndIds: &rbacconfig.Principal_Set{
+						Ids: []*rbacconfig.Principal{
+							{
+								Identifier: &rbacconfig.Principal_RemoteIp{
+									RemoteIp: &core.CidrRange{AddressPrefix: "10.0.0.0", PrefixLen: &types.UInt32Value{Value: 8}},
+								},
+							},
+							{
+								Identifier: &rbacconfig.Principal_Metadata{
+									Metadata: metadataMatcher("envoy.filters.http.jwt_authn", "tier", "gold"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestRBACJSONRoundTrip(t *testing.T) {
+	cases := []*rbacv4alpha.RBAC{
+		{},
+		{Rules: &rbacconfig.RBAC{Action: rbacconfig.RBAC_ALLOW}},
+		{
+			Rules:       &rbacconfig.RBAC{Action: rbacconfig.RBAC_DENY},
+			ShadowRules: &rbacconfig.RBAC{Action: rbacconfig.RBAC_ALLOW},
+		},
+		{
+			Rules: &rbacconfig.RBAC{
+				Action: rbacconfig.RBAC_ALLOW,
+				Policies: map[string]*rbacconfig.Policy{
+					"tree": policyWithTree(),
+				},
+			},
+		},
+	}
+
+	for _, want := range cases {
+		js, err := MarshalRBAC(want)
+		if err != nil {
+			t.Fatalf("MarshalRBAC: %v", err)
+		}
+		got := &rbacv4alpha.RBAC{}
+		if err := UnmarshalRBAC(js, got); err != nil {
+			t.Fatalf("UnmarshalRBAC(%s): %v", js, err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("round trip mismatch: got %s, want %s", got.String(), want.String())
+		}
+	}
+}
+
+func TestRBACYAMLRoundTrip(t *testing.T) {
+	want := &rbacv4alpha.RBAC{Rules: &rbacconfig.RBAC{Action: rbacconfig.RBAC_ALLOW}}
+
+	y, err := RBACToYAML(want)
+	if err != nil {
+		t.Fatalf("RBACToYAML: %v", err)
+	}
+	got, err := RBACFromYAML(y)
+	if err != nil {
+		t.Fatalf("RBACFromYAML(%s): %v", y, err)
+	}
+	if got.String() != want.String() {
+		t.Fatalf("yaml round trip mismatch: got %s, want %s", got.String(), want.String())
+	}
+}
+
+// permissionShapes and principalShapes are the oneof cases exercised by
+// TestRBACPerRouteJSONRoundTripFuzz, covering both leaf matchers and the
+// and/or/not composition that wraps them.
+var permissionShapes = []func() *rbacconfig.Permission{
+	func() *rbacconfig.Permission {
+		return &rbacconfig.Permission{Rule: &rbacconfig.Permission_Any{Any: true}}
+	},
+	func() *rbacconfig.Permission {
+		return &rbacconfig.Permission{Rule: &rbacconfig.Permission_Header{
+			Header: &route.HeaderMatcher{Name: ":method", HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "GET"}},
+		}}
+	},
+	func() *rbacconfig.Permission {
+		return &rbacconfig.Permission{Rule: &rbacconfig.Permission_NotRule{
+			NotRule: &rbacconfig.Permission{Rule: &rbacconfig.Permission_Any{Any: true}},
+		}}
+	},
+	func() *rbacconfig.Permission {
+		return &rbacconfig.Permission{Rule: &rbacconfig.Permission_AndRules{
+			AndRules: &rbacconfig.Permission_Set{Rules: []*rbacconfig.Permission{
+				{Rule: &rbacconfig.Permission_Any{Any: true}},
+				{Rule: &rbacconfig.Permission_UrlPath{UrlPath: matcherPathMatcher("/admin")}},
+			}},
+		}}
+	},
+	func() *rbacconfig.Permission {
+		return &rbacconfig.Permission{Rule: &rbacconfig.Permission_Metadata{
+			Metadata: metadataMatcher("envoy.filters.http.jwt_authn", "tier", "gold"),
+		}}
+	},
+}
+
+var principalShapes = []func() *rbacconfig.Principal{
+	func() *rbacconfig.Principal {
+		return &rbacconfig.Principal{Identifier: &rbacconfig.Principal_Any{Any: true}}
+	},
+	func() *rbacconfig.Principal {
+		return &rbacconfig.Principal{Identifier: &rbacconfig.Principal_RemoteIp{
+			RemoteIp: &core.CidrRange{AddressPrefix: "10.0.0.0", PrefixLen: &types.UInt32Value{Value: 8}},
+		}}
+	},
+	func() *rbacconfig.Principal {
+		return &rbacconfig.Principal{Identifier: &rbacconfig.Principal_OrIds{
+			OrIds: &rbacconfig.Principal_Set{Ids: []*rbacconfig.Principal{
+				{Identifier: &rbacconfig.Principal_Any{Any: true}},
+				{Identifier: &rbacconfig.Principal_Metadata{Metadata: metadataMatcher("envoy.filters.http.jwt_authn", "tier", "gold")}},
+			}},
+		}}
+	},
+}
+
+func matcherPathMatcher(path string) *matcher.PathMatcher {
+	return &matcher.PathMatcher{
+		Rule: &matcher.PathMatcher_Path{
+			Path: &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: path}},
+		},
+	}
+}
+
+// TestRBACPerRouteJSONRoundTripFuzz checks that proto -> json -> proto is
+// stable across randomly generated RBACPerRoute values, varying not just the
+// top-level Action but the shape of a Policy's Permission/Principal trees so
+// oneof discrimination and nested oneof values are actually exercised.
+func TestRBACPerRouteJSONRoundTripFuzz(t *testing.T) {
+	roundTrip := func(action, permShape, principalShape uint8) bool {
+		want := &rbacv4alpha.RBACPerRoute{
+			Rbac: &rbacv4alpha.RBAC{
+				Rules: &rbacconfig.RBAC{
+					Action: rbacconfig.RBAC_Action(action % 2),
+					Policies: map[string]*rbacconfig.Policy{
+						"fuzz": {
+							Permissions: []*rbacconfig.Permission{permissionShapes[int(permShape)%len(permissionShapes)]()},
+							Principals:  []*rbacconfig.Principal{principalShapes[int(principalShape)%len(principalShapes)]()},
+						},
+					},
+				},
+			},
+		}
+		js, err := MarshalRBACPerRoute(want)
+		if err != nil {
+			return false
+		}
+		got := &rbacv4alpha.RBACPerRoute{}
+		if err := UnmarshalRBACPerRoute(js, got); err != nil {
+			return false
+		}
+		return got.String() == want.String()
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Fatal(err)
+	}
+}